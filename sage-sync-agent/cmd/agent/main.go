@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/dms/sage-sync-agent/internal/config"
+	"github.com/dms/sage-sync-agent/internal/crashreporter"
 	"github.com/dms/sage-sync-agent/internal/queue"
+	"github.com/dms/sage-sync-agent/internal/rpc"
 	"github.com/dms/sage-sync-agent/internal/service"
+	"github.com/dms/sage-sync-agent/internal/supervisor"
 	"github.com/dms/sage-sync-agent/internal/uploader"
 	"github.com/dms/sage-sync-agent/internal/watcher"
 	"github.com/rs/zerolog"
@@ -20,6 +26,9 @@ var (
 	BuildTime = "unknown"
 )
 
+// logTailLines is how many recent log lines a crash bundle includes.
+const logTailLines = 200
+
 func main() {
 	install := flag.Bool("install", false, "Install as Windows service")
 	uninstall := flag.Bool("uninstall", false, "Uninstall Windows service")
@@ -28,6 +37,7 @@ func main() {
 	status := flag.Bool("status", false, "Show service status")
 	configPath := flag.String("config", "", "Path to config file")
 	setToken := flag.String("set-token", "", "Set API token securely")
+	rotateToken := flag.String("rotate-token", "", "Rotate the stored API token")
 	showVersion := flag.Bool("version", false, "Show version")
 	flag.Parse()
 
@@ -48,7 +58,8 @@ func main() {
 		os.Exit(1)
 	}
 
-	setupLogging(cfg)
+	logTail := crashreporter.NewLogRingBuffer(logTailLines)
+	setupLogging(cfg, logTail)
 
 	if *setToken != "" {
 		if err := config.StoreToken(*setToken); err != nil {
@@ -58,8 +69,20 @@ func main() {
 		os.Exit(0)
 	}
 
-	svc := service.New(cfg, func() error {
-		return runAgent(cfg)
+	if *rotateToken != "" {
+		if err := config.RotateToken(*rotateToken); err != nil {
+			log.Fatal().Err(err).Msg("Failed to rotate token")
+		}
+		log.Info().Msg("Token rotated securely")
+		os.Exit(0)
+	}
+
+	configJSON, _ := json.Marshal(cfg)
+	reporter := crashreporter.New("", cfg.DMSURL, Version, logTail)
+	defer reporter.RecoverPanic(string(configJSON))
+
+	svc := service.New(cfg, func(ctx context.Context) error {
+		return runAgent(ctx, cfgPath, cfg, reporter)
 	})
 
 	switch {
@@ -96,7 +119,7 @@ func main() {
 	}
 }
 
-func setupLogging(cfg *config.Config) {
+func setupLogging(cfg *config.Config, logTail *crashreporter.LogRingBuffer) {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
 	logPath := cfg.LogPath
@@ -111,14 +134,14 @@ func setupLogging(cfg *config.Config) {
 		0644,
 	)
 	if err != nil {
-		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+		log.Logger = zerolog.New(zerolog.MultiLevelWriter(os.Stderr, logTail)).With().Timestamp().Logger()
 		log.Warn().Err(err).Msg("Could not open log file, using stderr")
 	} else {
-		log.Logger = zerolog.New(logFile).With().Timestamp().Logger()
+		log.Logger = zerolog.New(zerolog.MultiLevelWriter(logFile, logTail)).With().Timestamp().Logger()
 	}
 }
 
-func runAgent(cfg *config.Config) error {
+func runAgent(ctx context.Context, cfgPath string, cfg *config.Config, reporter *crashreporter.Reporter) error {
 	log.Info().
 		Str("version", Version).
 		Str("watch_folder", cfg.WatchFolder).
@@ -130,17 +153,123 @@ func runAgent(cfg *config.Config) error {
 		return fmt.Errorf("no API token configured: %w", err)
 	}
 
-	q, err := queue.New(cfg.QueuePath)
+	q, err := queue.New(cfg.QueuePath, classRules(cfg))
 	if err != nil {
 		return fmt.Errorf("failed to initialize queue: %w", err)
 	}
-	defer q.Close()
 
-	up := uploader.New(cfg.DMSURL, token, cfg.ProcessedFolder)
+	up := uploader.New(cfg.DMSURL, token, cfg.ProcessedFolder, cfg.TenantCode, cfg.UploadProtocol, cfg.HashPrecheck, rateLimits(cfg))
+	up.SetErrorReporter(reporter)
 	w := watcher.New(cfg.WatchFolder, cfg.IncludePatterns, cfg.StabilitySeconds, q)
 
-	go up.Start(q)
-	go up.StartHeartbeat(cfg.HeartbeatInterval, Version)
+	sup := supervisor.New()
+	sup.SetPanicHook(reporter.ReportChildPanic)
+	sup.Register(supervisor.Child{
+		Name:    "watcher",
+		Restart: supervisor.Permanent,
+		Run:     w.Start,
+	})
+	sup.Register(supervisor.Child{
+		Name:    "uploader",
+		Restart: supervisor.Permanent,
+		Run: func(ctx context.Context) error {
+			return up.Start(ctx, q)
+		},
+	})
+	sup.Register(supervisor.Child{
+		Name:    "heartbeat",
+		Restart: supervisor.Permanent,
+		Run: func(ctx context.Context) error {
+			return up.StartHeartbeat(ctx, cfg.HeartbeatInterval, Version, cfg.WatchFolder, q, w.Rescan, func() {
+				reporter.SendPending(up.Token())
+			}, config.TokenSource)
+		},
+	})
+	rpcClient := rpc.New(cfg.DMSURL, token, rpc.Handlers{
+		Status: func() (rpc.StatusResult, error) {
+			return rpc.StatusResult{QueueDepth: q.Size(), CurrentUpload: up.CurrentUpload(), Version: Version, Classes: q.ClassCounts()}, nil
+		},
+		Pause: func() error {
+			up.Pause()
+			return nil
+		},
+		Resume: func() error {
+			up.Resume()
+			return nil
+		},
+		RescanFolder: func() error {
+			w.Rescan()
+			return nil
+		},
+		RetryNow: func(path string) error {
+			return q.ResetRetry(path)
+		},
+		ReloadConfig: func() error {
+			newCfg, err := config.Load(cfgPath)
+			if err != nil {
+				return fmt.Errorf("failed to reload config: %w", err)
+			}
+			w.UpdateSettings(newCfg.IncludePatterns, newCfg.StabilitySeconds)
+			log.Info().Msg("Config reloaded")
+			return nil
+		},
+		RotateToken: func(newToken string) error {
+			if err := config.StoreToken(newToken); err != nil {
+				return fmt.Errorf("failed to store rotated token: %w", err)
+			}
+			up.SetToken(newToken)
+			return nil
+		},
+	}, q)
+	up.SetNotifier(rpcClient)
+	w.SetNotifier(rpcClient)
+
+	sup.Register(supervisor.Child{
+		Name:    "rpc",
+		Restart: supervisor.Permanent,
+		Run:     rpcClient.Start,
+	})
+	sup.Register(supervisor.Child{
+		Name:    "queue",
+		Restart: supervisor.Temporary,
+		Run: func(ctx context.Context) error {
+			// Keeps the queue's lifecycle inside the supervision tree so it
+			// closes only after the other children have drained, instead of
+			// racing their shutdown via a bare defer.
+			<-ctx.Done()
+			return q.Close()
+		},
+	})
+
+	sup.Run(ctx)
+	return nil
+}
+
+// classRules converts the configured class rules into the queue package's
+// representation so that package doesn't need to import config.
+func classRules(cfg *config.Config) []queue.ClassRule {
+	rules := make([]queue.ClassRule, len(cfg.ClassRules))
+	for i, r := range cfg.ClassRules {
+		rules[i] = queue.ClassRule{
+			Pattern:       r.Pattern,
+			Class:         r.Class,
+			Priority:      r.Priority,
+			SLA:           time.Duration(r.SLASeconds) * time.Second,
+			RatePerMinute: r.RatePerMinute,
+		}
+	}
+	return rules
+}
 
-	return w.Start()
+// rateLimits maps each configured class to its per-minute upload budget for
+// the uploader's token-bucket limiter; classes without a rule are
+// unlimited.
+func rateLimits(cfg *config.Config) map[string]int {
+	limits := make(map[string]int, len(cfg.ClassRules))
+	for _, r := range cfg.ClassRules {
+		if r.RatePerMinute > 0 {
+			limits[r.Class] = r.RatePerMinute
+		}
+	}
+	return limits
 }
@@ -8,15 +8,37 @@ import (
 )
 
 type Config struct {
-	DMSURL            string   `yaml:"dms_url"`
-	WatchFolder       string   `yaml:"watch_folder"`
-	ProcessedFolder   string   `yaml:"processed_folder"`
-	TenantCode        string   `yaml:"tenant_code"`
-	IncludePatterns   []string `yaml:"include_patterns"`
-	QueuePath         string   `yaml:"queue_path"`
-	LogPath           string   `yaml:"log_path"`
-	StabilitySeconds  int      `yaml:"stability_seconds"`
-	HeartbeatInterval int      `yaml:"heartbeat_interval_seconds"`
+	DMSURL            string      `yaml:"dms_url"`
+	WatchFolder       string      `yaml:"watch_folder"`
+	ProcessedFolder   string      `yaml:"processed_folder"`
+	TenantCode        string      `yaml:"tenant_code"`
+	IncludePatterns   []string    `yaml:"include_patterns"`
+	QueuePath         string      `yaml:"queue_path"`
+	LogPath           string      `yaml:"log_path"`
+	StabilitySeconds  int         `yaml:"stability_seconds"`
+	HeartbeatInterval int         `yaml:"heartbeat_interval_seconds"`
+	ClassRules        []ClassRule `yaml:"class_rules"`
+
+	// UploadProtocol selects the transfer protocol the uploader uses:
+	// "chunked" (default) for the agent's own resumable PATCH protocol, or
+	// "tus" to speak tus.io against a DMS that exposes a tus endpoint.
+	UploadProtocol string `yaml:"upload_protocol"`
+
+	// HashPrecheck, when true, has the uploader ask the DMS whether a file's
+	// hash is already ingested before streaming it, skipping the transfer
+	// entirely on a hit.
+	HashPrecheck bool `yaml:"hash_precheck"`
+}
+
+// ClassRule assigns a document class and scheduling priority to files whose
+// name matches Pattern (a filepath.Match glob, e.g. "*INVOICE*.pdf"). Rules
+// are evaluated in order and the first match wins.
+type ClassRule struct {
+	Pattern       string `yaml:"pattern"`
+	Class         string `yaml:"class"`
+	Priority      int    `yaml:"priority"`
+	SLASeconds    int    `yaml:"sla_seconds"`
+	RatePerMinute int    `yaml:"rate_per_minute"`
 }
 
 func Load(path string) (*Config, error) {
@@ -51,6 +73,7 @@ func defaultConfig() *Config {
 		LogPath:           "",
 		StabilitySeconds:  5,
 		HeartbeatInterval: 300,
+		UploadProtocol:    "chunked",
 	}
 }
 
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// tokenSource tracks how the credential currently backing GetToken was
+// obtained, so heartbeat can report each agent's security posture
+// ("credmgr" is strongest, "plaintext-file" is the weakest fallback and
+// worth flagging to an operator).
+var (
+	tokenSourceMu sync.Mutex
+	tokenSource   = "plaintext-file"
+)
+
+// TokenSource returns the storage backend the last successful StoreToken or
+// GetToken call used: "credmgr", "dpapi-file" or "plaintext-file".
+func TokenSource() string {
+	tokenSourceMu.Lock()
+	defer tokenSourceMu.Unlock()
+	return tokenSource
+}
+
+func setTokenSource(source string) {
+	tokenSourceMu.Lock()
+	tokenSource = source
+	tokenSourceMu.Unlock()
+}
+
+// StoreToken persists token, preferring the platform credential manager
+// (DPAPI-wrapped on Windows) and falling back to a file otherwise.
+func StoreToken(token string) error {
+	if runtime.GOOS == "windows" {
+		if err := storeTokenWindows(token); err == nil {
+			setTokenSource("credmgr")
+			return nil
+		}
+	}
+	return storeTokenFile(token)
+}
+
+// RotateToken replaces the stored token with newToken. It is the entry
+// point the -rotate-token CLI verb and the RPC RotateToken handler both
+// use: neither needs to do anything beyond calling this, since StoreToken
+// already wraps newToken under freshly generated protection rather than
+// reusing whatever entropy guarded the previous token.
+func RotateToken(newToken string) error {
+	return StoreToken(newToken)
+}
+
+func GetToken() (string, error) {
+	if runtime.GOOS == "windows" {
+		token, err := getTokenWindows()
+		if err == nil && token != "" {
+			setTokenSource("credmgr")
+			return token, nil
+		}
+	}
+	return getTokenFile()
+}
+
+func storeTokenFile(token string) error {
+	path := getTokenFilePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	wrapped, err := wrapForDisk([]byte(token))
+	if err != nil {
+		return fmt.Errorf("failed to protect token for disk: %w", err)
+	}
+
+	// Write-then-rename so a crash mid-write can never leave a truncated
+	// token file behind for GetToken to trip over.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, wrapped, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	if err := restrictFileACL(path); err != nil {
+		return fmt.Errorf("failed to restrict token file permissions: %w", err)
+	}
+
+	setTokenSource(fileTokenSource())
+	return nil
+}
+
+func getTokenFile() (string, error) {
+	path := getTokenFilePath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 {
+		return "", errors.New("token file is empty")
+	}
+
+	token, err := unwrapForDisk(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to unprotect token file: %w", err)
+	}
+
+	setTokenSource(fileTokenSource())
+	return string(token), nil
+}
+
+// fileTokenSource reports which protection the file fallback relies on:
+// DPAPI on Windows, plaintext everywhere else.
+func fileTokenSource() string {
+	if runtime.GOOS == "windows" {
+		return "dpapi-file"
+	}
+	return "plaintext-file"
+}
+
+func getTokenFilePath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "SageSyncAgent", ".token")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".sage-sync-agent", ".token")
+}
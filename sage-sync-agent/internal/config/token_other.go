@@ -2,10 +2,27 @@
 
 package config
 
+import "fmt"
+
+// wrapForDisk, unwrapForDisk and restrictFileACL are no-ops off Windows:
+// there's no DPAPI to wrap with, and file permissions are already enforced
+// by the 0600 mode storeTokenFile writes with.
+func wrapForDisk(plain []byte) ([]byte, error) {
+	return plain, nil
+}
+
+func unwrapForDisk(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func restrictFileACL(path string) error {
+	return nil
+}
+
 func storeTokenWindows(token string) error {
-	return storeTokenFile(token)
+	return fmt.Errorf("credential manager is only available on windows")
 }
 
 func getTokenWindows() (string, error) {
-	return getTokenFile()
+	return "", fmt.Errorf("credential manager is only available on windows")
 }
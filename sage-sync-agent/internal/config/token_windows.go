@@ -0,0 +1,324 @@
+//go:build windows
+
+package config
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// credTypeGeneric (CRED_TYPE_GENERIC) is the type Windows expects an
+	// application storing its own opaque secret to use; CRED_TYPE_DOMAIN_PASSWORD
+	// is reserved for actual logon/domain credentials, caps the blob far
+	// smaller, and requires a UserName we don't have one of.
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+)
+
+// cryptprotectLocalMachine scopes the DPAPI key to the machine rather than
+// the calling user, so the token can still be unprotected after a reboot
+// by the LocalSystem account the service runs as, instead of being tied to
+// whichever interactive user happened to install it.
+const cryptprotectLocalMachine = 0x4
+
+var (
+	advapi32       = syscall.NewLazyDLL("advapi32.dll")
+	procCredWriteW = advapi32.NewProc("CredWriteW")
+	procCredReadW  = advapi32.NewProc("CredReadW")
+	procCredFree   = advapi32.NewProc("CredFree")
+
+	procSetNamedSecurityInfoW  = advapi32.NewProc("SetNamedSecurityInfoW")
+	procSetEntriesInAclW       = advapi32.NewProc("SetEntriesInAclW")
+	procConvertStringSidToSidW = advapi32.NewProc("ConvertStringSidToSidW")
+
+	crypt32                = syscall.NewLazyDLL("crypt32.dll")
+	procCryptProtectData   = crypt32.NewProc("CryptProtectData")
+	procCryptUnprotectData = crypt32.NewProc("CryptUnprotectData")
+
+	kernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLocalFree = kernel32.NewProc("LocalFree")
+)
+
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+type dataBlob struct {
+	cbData uint32
+	pbData *byte
+}
+
+const targetName = "SageSyncAgent_Token"
+
+// storeTokenWindows wraps token with DPAPI under fresh, per-call entropy
+// before handing it to Credential Manager, so a copy of the credential
+// store alone (e.g. a stolen backup) isn't enough to recover the token
+// without also compromising the machine's DPAPI key.
+func storeTokenWindows(token string) error {
+	wrapped, err := wrapWithEntropy([]byte(token))
+	if err != nil {
+		return fmt.Errorf("failed to protect token: %w", err)
+	}
+
+	targetPtr, _ := syscall.UTF16PtrFromString(targetName)
+
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         targetPtr,
+		CredentialBlobSize: uint32(len(wrapped)),
+		CredentialBlob:     &wrapped[0],
+		Persist:            credPersistLocalMachine,
+	}
+
+	ret, _, err := procCredWriteW.Call(
+		uintptr(unsafe.Pointer(&cred)),
+		0,
+	)
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+func getTokenWindows() (string, error) {
+	targetPtr, _ := syscall.UTF16PtrFromString(targetName)
+	var pcred *credential
+
+	ret, _, err := procCredReadW.Call(
+		uintptr(unsafe.Pointer(targetPtr)),
+		uintptr(credTypeGeneric),
+		0,
+		uintptr(unsafe.Pointer(&pcred)),
+	)
+	if ret == 0 {
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(pcred)))
+
+	wrapped := make([]byte, pcred.CredentialBlobSize)
+	copy(wrapped, (*[1 << 20]byte)(unsafe.Pointer(pcred.CredentialBlob))[:pcred.CredentialBlobSize])
+
+	token, err := unwrapWithEntropy(wrapped)
+	if err != nil {
+		return "", fmt.Errorf("failed to unprotect token: %w", err)
+	}
+	return string(token), nil
+}
+
+// wrapForDisk and unwrapForDisk are the Windows side of the cross-platform
+// hook token.go calls around the file fallback, so the file written when
+// Credential Manager is unavailable is DPAPI-protected rather than
+// plaintext.
+func wrapForDisk(plain []byte) ([]byte, error) {
+	return wrapWithEntropy(plain)
+}
+
+func unwrapForDisk(data []byte) ([]byte, error) {
+	return unwrapWithEntropy(data)
+}
+
+// wrapWithEntropy generates fresh secondary entropy, DPAPI-protects plain
+// under it, and returns [4-byte entropy length][entropy][ciphertext] so
+// the entropy travels alongside the blob it guards. A fresh call always
+// uses new entropy, so rotating a token naturally re-wraps it instead of
+// reusing whatever guarded the previous one.
+func wrapWithEntropy(plain []byte) ([]byte, error) {
+	entropy := make([]byte, 32)
+	if _, err := rand.Read(entropy); err != nil {
+		return nil, err
+	}
+
+	cipher, err := cryptProtectData(plain, entropy)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 4+len(entropy)+len(cipher))
+	binary.LittleEndian.PutUint32(out[0:4], uint32(len(entropy)))
+	copy(out[4:], entropy)
+	copy(out[4+len(entropy):], cipher)
+	return out, nil
+}
+
+func unwrapWithEntropy(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("protected blob too short")
+	}
+	entropyLen := binary.LittleEndian.Uint32(data[0:4])
+	if uint64(4+entropyLen) > uint64(len(data)) {
+		return nil, fmt.Errorf("protected blob truncated")
+	}
+	entropy := data[4 : 4+entropyLen]
+	cipher := data[4+entropyLen:]
+	return cryptUnprotectData(cipher, entropy)
+}
+
+func cryptProtectData(plain, entropy []byte) ([]byte, error) {
+	in := dataBlob{cbData: uint32(len(plain)), pbData: &plain[0]}
+	ent := dataBlob{cbData: uint32(len(entropy)), pbData: &entropy[0]}
+	var out dataBlob
+
+	ret, _, err := procCryptProtectData.Call(
+		uintptr(unsafe.Pointer(&in)),
+		0,
+		uintptr(unsafe.Pointer(&ent)),
+		0,
+		0,
+		cryptprotectLocalMachine,
+		uintptr(unsafe.Pointer(&out)),
+	)
+	if ret == 0 {
+		return nil, err
+	}
+	defer procLocalFree.Call(uintptr(unsafe.Pointer(out.pbData)))
+
+	cipher := make([]byte, out.cbData)
+	copy(cipher, (*[1 << 20]byte)(unsafe.Pointer(out.pbData))[:out.cbData])
+	return cipher, nil
+}
+
+func cryptUnprotectData(cipher, entropy []byte) ([]byte, error) {
+	in := dataBlob{cbData: uint32(len(cipher)), pbData: &cipher[0]}
+	ent := dataBlob{cbData: uint32(len(entropy)), pbData: &entropy[0]}
+	var out dataBlob
+
+	ret, _, err := procCryptUnprotectData.Call(
+		uintptr(unsafe.Pointer(&in)),
+		0,
+		uintptr(unsafe.Pointer(&ent)),
+		0,
+		0,
+		cryptprotectLocalMachine,
+		uintptr(unsafe.Pointer(&out)),
+	)
+	if ret == 0 {
+		return nil, err
+	}
+	defer procLocalFree.Call(uintptr(unsafe.Pointer(out.pbData)))
+
+	plain := make([]byte, out.cbData)
+	copy(plain, (*[1 << 20]byte)(unsafe.Pointer(out.pbData))[:out.cbData])
+	return plain, nil
+}
+
+// explicitAccess and trustee mirror enough of EXPLICIT_ACCESS_W/TRUSTEE_W
+// for restrictFileACL's two grants; fields the call never sets (inheritance
+// flags, multi-trustee fan-out) are left at their zero value.
+type explicitAccess struct {
+	grfAccessPermissions uint32
+	grfAccessMode        uint32
+	grfInheritance       uint32
+	trustee              trustee
+}
+
+type trustee struct {
+	pMultipleTrustee  uintptr
+	multipleTrusteeOp uint32
+	trusteeForm       uint32
+	trusteeType       uint32
+	ptstrName         uintptr
+}
+
+const (
+	genericAll    = 0x10000000
+	setAccess     = 2
+	trusteeIsSid  = 0
+	sePathObject  = 1
+	dacliSecurity = 0x4
+)
+
+// restrictFileACL replaces the token file's DACL with exactly two grants,
+// NT AUTHORITY\SYSTEM and BUILTIN\Administrators, both full control, so a
+// non-admin local account can't read the fallback file even though Unix
+// mode bits carry no meaning on an NTFS volume.
+func restrictFileACL(path string) error {
+	systemSID, err := stringToSid("S-1-5-18")
+	if err != nil {
+		return fmt.Errorf("failed to resolve SYSTEM sid: %w", err)
+	}
+	adminsSID, err := stringToSid("S-1-5-32-544")
+	if err != nil {
+		return fmt.Errorf("failed to resolve Administrators sid: %w", err)
+	}
+
+	entries := []explicitAccess{
+		{
+			grfAccessPermissions: genericAll,
+			grfAccessMode:        setAccess,
+			trustee: trustee{
+				trusteeForm: trusteeIsSid,
+				ptstrName:   uintptr(unsafe.Pointer(systemSID)),
+			},
+		},
+		{
+			grfAccessPermissions: genericAll,
+			grfAccessMode:        setAccess,
+			trustee: trustee{
+				trusteeForm: trusteeIsSid,
+				ptstrName:   uintptr(unsafe.Pointer(adminsSID)),
+			},
+		},
+	}
+
+	var newACL uintptr
+	ret, _, _ := procSetEntriesInAclW.Call(
+		uintptr(len(entries)),
+		uintptr(unsafe.Pointer(&entries[0])),
+		0,
+		uintptr(unsafe.Pointer(&newACL)),
+	)
+	if ret != 0 {
+		return fmt.Errorf("SetEntriesInAclW failed: %#x", ret)
+	}
+	defer procLocalFree.Call(newACL)
+
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	ret, _, _ = procSetNamedSecurityInfoW.Call(
+		uintptr(unsafe.Pointer(pathPtr)),
+		sePathObject,
+		dacliSecurity,
+		0,
+		0,
+		newACL,
+		0,
+	)
+	if ret != 0 {
+		return fmt.Errorf("SetNamedSecurityInfoW failed: %#x", ret)
+	}
+	return nil
+}
+
+func stringToSid(sid string) (*uint16, error) {
+	sidPtr, err := syscall.UTF16PtrFromString(sid)
+	if err != nil {
+		return nil, err
+	}
+	var out *uint16
+	ret, _, err := procConvertStringSidToSidW.Call(
+		uintptr(unsafe.Pointer(sidPtr)),
+		uintptr(unsafe.Pointer(&out)),
+	)
+	if ret == 0 {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,241 @@
+// Package crashreporter captures panics and exhausted-retry upload
+// failures to a local bundle, then ships pending bundles to the DMS the
+// next time a heartbeat succeeds, so an operator can diagnose a failure on
+// a customer's machine without needing access to it.
+package crashreporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LogRingBuffer is a zerolog io.Writer that keeps only the most recent
+// lines in memory, so a crash bundle can include recent log context
+// without re-reading (or growing unbounded alongside) the on-disk log file.
+type LogRingBuffer struct {
+	mu    sync.Mutex
+	lines []string
+	max   int
+}
+
+// NewLogRingBuffer returns a ring buffer retaining at most max lines.
+func NewLogRingBuffer(max int) *LogRingBuffer {
+	return &LogRingBuffer{max: max}
+}
+
+func (r *LogRingBuffer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lines = append(r.lines, string(bytes.TrimRight(p, "\n")))
+	if len(r.lines) > r.max {
+		r.lines = r.lines[len(r.lines)-r.max:]
+	}
+	return len(p), nil
+}
+
+// Tail returns the buffered lines newline-joined, oldest first.
+func (r *LogRingBuffer) Tail() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.lines, "\n")
+}
+
+// Reporter writes crash and upload-error bundles to dir and ships whatever
+// is pending there to the DMS on the next successful heartbeat.
+type Reporter struct {
+	dir     string
+	dmsURL  string
+	version string
+	ring    *LogRingBuffer
+	client  *http.Client
+}
+
+// New returns a Reporter. An empty dir falls back to a default location
+// alongside the queue database and log files.
+func New(dir, dmsURL, version string, ring *LogRingBuffer) *Reporter {
+	if dir == "" {
+		dir = getDefaultCrashDir()
+	}
+	return &Reporter{
+		dir:     dir,
+		dmsURL:  dmsURL,
+		version: version,
+		ring:    ring,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// RecoverPanic should be deferred at the very top of main. It writes a
+// crash bundle with the panic value, a full stack trace, the recent log
+// tail and a redacted config snapshot, then re-panics so the service
+// manager's restart policy still applies.
+func (r *Reporter) RecoverPanic(configRedacted string) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+
+	r.writeBundle(map[string]string{
+		"kind":            "crash",
+		"agent_version":   r.version,
+		"os":              runtime.GOOS,
+		"go_version":      runtime.Version(),
+		"stack":           fmt.Sprintf("panic: %v\n%s", rec, allStacks()),
+		"log_tail":        r.ring.Tail(),
+		"config_redacted": configRedacted,
+	})
+
+	panic(rec)
+}
+
+// ReportChildPanic writes a crash bundle for a panic the supervisor
+// recovered in one of its children. main's own top-level recover (via
+// RecoverPanic) can never see these, since each supervised child runs on
+// its own goroutine, so the supervisor calls this directly through its
+// panic hook instead.
+func (r *Reporter) ReportChildPanic(childName string, rec interface{}, stack string) {
+	r.writeBundle(map[string]string{
+		"kind":          "crash",
+		"agent_version": r.version,
+		"os":            runtime.GOOS,
+		"go_version":    runtime.Version(),
+		"child":         childName,
+		"stack":         fmt.Sprintf("panic: %v\n%s", rec, stack),
+		"log_tail":      r.ring.Tail(),
+	})
+}
+
+// allStacks dumps every goroutine's stack, not just the panicking one, so a
+// crash bundle is actually useful for diagnosing a concurrency bug.
+func allStacks() []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// ReportUploadError writes a lighter bundle for a file whose upload
+// exhausted its retry budget, capturing just enough to diagnose a
+// tenant-specific ingest regression: the file's hash, size and sniffed
+// MIME type, plus the server's last response.
+func (r *Reporter) ReportUploadError(path, hash, mimeType string, size int64, statusCode int, responseSnippet string) {
+	r.writeBundle(map[string]string{
+		"kind":             "upload_error",
+		"agent_version":    r.version,
+		"path":             path,
+		"sha256":           hash,
+		"mime_type":        mimeType,
+		"size":             strconv.FormatInt(size, 10),
+		"status_code":      strconv.Itoa(statusCode),
+		"response_snippet": responseSnippet,
+	})
+}
+
+func (r *Reporter) writeBundle(fields map[string]string) {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		log.Error().Err(err).Msg("Failed to create crash dump directory")
+		return
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal crash bundle")
+		return
+	}
+
+	path := filepath.Join(r.dir, fmt.Sprintf("%s_%d.json", fields["kind"], time.Now().UnixNano()))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		log.Error().Err(err).Msg("Failed to write crash bundle")
+	}
+}
+
+// SendPending uploads every bundle currently on disk to the DMS as a
+// multipart POST, deleting each file once it's acknowledged. Call it after
+// a successful heartbeat so pending bundles piggyback on connectivity the
+// agent just proved it has, rather than retrying on their own schedule.
+func (r *Reporter) SendPending(token string) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(r.dir, e.Name())
+		if err := r.send(path, token); err != nil {
+			log.Debug().Err(err).Str("bundle", e.Name()).Msg("Failed to send crash bundle, will retry next heartbeat")
+			continue
+		}
+		os.Remove(path)
+	}
+}
+
+func (r *Reporter) send(path, token string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var fields map[string]string
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for k, v := range fields {
+		if err := w.WriteField(k, v); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/api/v1/agent/crash/", r.dmsURL)
+	req, err := http.NewRequest(http.MethodPost, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("X-DMS-Token", token)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("crash report upload failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func getDefaultCrashDir() string {
+	if os.Getenv("ProgramData") != "" {
+		return filepath.Join(os.Getenv("ProgramData"), "SageSyncAgent", "crashes")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".sage-sync-agent", "crashes")
+}
@@ -1,32 +1,73 @@
 package queue
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	bolt "go.etcd.io/bbolt"
 )
 
-var bucketName = []byte("pending_files")
+var (
+	bucketName     = []byte("pending_files")
+	readyIndexName = []byte("ready_index")
+)
 
 type FileEntry struct {
-	Path       string    `json:"path"`
-	Size       int64     `json:"size"`
-	QueuedAt   time.Time `json:"queued_at"`
-	Retries    int       `json:"retries"`
-	LastError  string    `json:"last_error,omitempty"`
-	NextRetry  time.Time `json:"next_retry"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	QueuedAt  time.Time `json:"queued_at"`
+	Retries   int       `json:"retries"`
+	LastError string    `json:"last_error,omitempty"`
+	NextRetry time.Time `json:"next_retry"`
+
+	// UploadID, Offset and Checksum track an in-progress resumable upload
+	// so a retry after a partial transfer continues instead of restarting
+	// from byte zero.
+	UploadID string `json:"upload_id,omitempty"`
+	Offset   int64  `json:"offset,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+
+	// Priority, Deadline and Class drive scheduling order: lower Priority
+	// values are more urgent (negative = higher than default), Deadline is
+	// an optional SLA the file should be uploaded by, and Class groups
+	// files for the per-class rate limiter and telemetry.
+	Priority int       `json:"priority"`
+	Deadline time.Time `json:"deadline,omitempty"`
+	Class    string    `json:"class,omitempty"`
+}
+
+// ClassRule assigns a Class, Priority and optional SLA/rate limit to files
+// whose name matches Pattern. Rules are evaluated in order, first match
+// wins; a file matching no rule gets the zero value (default priority, no
+// class, no SLA).
+type ClassRule struct {
+	Pattern       string
+	Class         string
+	Priority      int
+	SLA           time.Duration
+	RatePerMinute int
 }
 
 type Queue struct {
-	db *bolt.DB
+	db         *bolt.DB
+	classRules []ClassRule
+
+	// completedTotal and lastUpload are process-lifetime counters for
+	// heartbeat telemetry; they reset on restart rather than persisting,
+	// since they describe this run's activity, not the durable queue state.
+	completedTotal int64
+	lastUpload     atomic.Value // time.Time
 }
 
-func New(path string) (*Queue, error) {
+func New(path string, classRules []ClassRule) (*Queue, error) {
 	if path == "" {
 		path = getDefaultQueuePath()
 	}
@@ -41,7 +82,10 @@ func New(path string) (*Queue, error) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bucketName)
+		if _, err := tx.CreateBucketIfNotExists(bucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(readyIndexName)
 		return err
 	})
 	if err != nil {
@@ -49,7 +93,7 @@ func New(path string) (*Queue, error) {
 		return nil, err
 	}
 
-	return &Queue{db: db}, nil
+	return &Queue{db: db, classRules: classRules}, nil
 }
 
 func (q *Queue) Close() error {
@@ -57,12 +101,19 @@ func (q *Queue) Close() error {
 }
 
 func (q *Queue) Enqueue(path string, size int64) error {
+	class, priority, sla := classify(path, q.classRules)
+
 	entry := FileEntry{
 		Path:      path,
 		Size:      size,
 		QueuedAt:  time.Now(),
 		Retries:   0,
 		NextRetry: time.Now(),
+		Priority:  priority,
+		Class:     class,
+	}
+	if sla > 0 {
+		entry.Deadline = entry.QueuedAt.Add(sla)
 	}
 
 	data, err := json.Marshal(entry)
@@ -72,27 +123,50 @@ func (q *Queue) Enqueue(path string, size int64) error {
 
 	return q.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucketName)
-		return b.Put([]byte(path), data)
+		if err := b.Put([]byte(path), data); err != nil {
+			return err
+		}
+		idx := tx.Bucket(readyIndexName)
+		return idx.Put(readyIndexKey(entry), []byte(path))
 	})
 }
 
-func (q *Queue) Dequeue() (*FileEntry, error) {
+// Dequeue returns the most urgent ready entry whose class isAllowed accepts:
+// the ready index is keyed so that an ascending scan visits files in
+// (priority, deadline, queued-at) order, skipping over the rare
+// not-yet-eligible entry (still backing off after a prior failure) rather
+// than walking the whole bucket in insertion order as before. isAllowed, if
+// non-nil, is consulted for each candidate in turn so a class that has hit
+// its rate limit is skipped in favor of the next eligible entry instead of
+// head-of-line-blocking every class behind it.
+func (q *Queue) Dequeue(isAllowed func(class string) bool) (*FileEntry, error) {
 	var entry *FileEntry
 	now := time.Now()
 
 	err := q.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucketName)
-		c := b.Cursor()
+		idx := tx.Bucket(readyIndexName)
+		c := idx.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
+			data := b.Get(v)
+			if data == nil {
+				// Stale index entry left behind by a crash between the two
+				// bucket writes; ignore it.
+				continue
+			}
+
 			var e FileEntry
-			if err := json.Unmarshal(v, &e); err != nil {
+			if err := json.Unmarshal(data, &e); err != nil {
 				continue
 			}
 
 			if e.NextRetry.After(now) {
 				continue
 			}
+			if isAllowed != nil && !isAllowed(e.Class) {
+				continue
+			}
 
 			entry = &e
 			return nil
@@ -104,10 +178,24 @@ func (q *Queue) Dequeue() (*FileEntry, error) {
 }
 
 func (q *Queue) MarkComplete(path string) error {
-	return q.db.Update(func(tx *bolt.Tx) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucketName)
+		data := b.Get([]byte(path))
+		if data != nil {
+			var entry FileEntry
+			if err := json.Unmarshal(data, &entry); err == nil {
+				tx.Bucket(readyIndexName).Delete(readyIndexKey(entry))
+			}
+		}
 		return b.Delete([]byte(path))
 	})
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&q.completedTotal, 1)
+	q.lastUpload.Store(time.Now())
+	return nil
 }
 
 func (q *Queue) MarkFailed(path string, errMsg string) error {
@@ -134,6 +222,62 @@ func (q *Queue) MarkFailed(path string, errMsg string) error {
 			Str("error", errMsg).
 			Msg("Upload failed, scheduling retry")
 
+		newData, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		// NextRetry isn't part of the ready index key, so the index entry
+		// is still valid; Dequeue re-checks NextRetry against the primary
+		// record before returning a candidate.
+		return b.Put([]byte(path), newData)
+	})
+}
+
+// UpdateProgress persists the resumable upload state for an in-flight
+// transfer so a crash or restart can pick up from the last committed
+// offset instead of re-uploading the whole file.
+func (q *Queue) UpdateProgress(path, uploadID string, offset int64, checksum string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		data := b.Get([]byte(path))
+		if data == nil {
+			return fmt.Errorf("entry not found: %s", path)
+		}
+
+		var entry FileEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+
+		entry.UploadID = uploadID
+		entry.Offset = offset
+		entry.Checksum = checksum
+
+		newData, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(path), newData)
+	})
+}
+
+// ResetRetry clears an entry's backoff so it becomes eligible for the next
+// Dequeue immediately, e.g. in response to an operator-triggered retry.
+func (q *Queue) ResetRetry(path string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		data := b.Get([]byte(path))
+		if data == nil {
+			return fmt.Errorf("entry not found: %s", path)
+		}
+
+		var entry FileEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+
+		entry.NextRetry = time.Now()
+
 		newData, err := json.Marshal(entry)
 		if err != nil {
 			return err
@@ -152,6 +296,121 @@ func (q *Queue) Size() int {
 	return count
 }
 
+// Stats is the fleet-visible health snapshot reported in heartbeat
+// payloads, so the DMS can drive dashboards and alerting on stuck agents.
+type Stats struct {
+	Pending          int
+	Failed           int
+	CompletedTotal   int
+	OldestPendingAge time.Duration
+	LastUploadAt     time.Time
+}
+
+// Stats summarizes the current queue: Pending is entries never yet failed,
+// Failed is entries currently backing off after at least one failed
+// attempt, and CompletedTotal/LastUploadAt track this process's lifetime
+// upload activity (they reset across restarts).
+func (q *Queue) Stats() Stats {
+	stats := Stats{CompletedTotal: int(atomic.LoadInt64(&q.completedTotal))}
+	if v := q.lastUpload.Load(); v != nil {
+		stats.LastUploadAt = v.(time.Time)
+	}
+
+	now := time.Now()
+	q.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		return b.ForEach(func(_, v []byte) error {
+			var e FileEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return nil
+			}
+
+			if e.Retries > 0 {
+				stats.Failed++
+			} else {
+				stats.Pending++
+			}
+			if age := now.Sub(e.QueuedAt); age > stats.OldestPendingAge {
+				stats.OldestPendingAge = age
+			}
+			return nil
+		})
+	})
+
+	return stats
+}
+
+// ClassCount is the per-class telemetry reported alongside RPC status and
+// heartbeat payloads.
+type ClassCount struct {
+	Depth     int           `json:"depth"`
+	OldestAge time.Duration `json:"oldest_age"`
+}
+
+// ClassCounts returns queue depth and oldest-pending age grouped by Class,
+// so operators can see a single stuck class (e.g. a misbehaving tenant)
+// without it being masked by the overall queue depth.
+func (q *Queue) ClassCounts() map[string]ClassCount {
+	counts := make(map[string]ClassCount)
+	now := time.Now()
+
+	q.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		return b.ForEach(func(_, v []byte) error {
+			var e FileEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return nil
+			}
+
+			c := counts[e.Class]
+			c.Depth++
+			if age := now.Sub(e.QueuedAt); age > c.OldestAge {
+				c.OldestAge = age
+			}
+			counts[e.Class] = c
+			return nil
+		})
+	})
+
+	return counts
+}
+
+// readyIndexKey builds the ready_index key for entry: priority (ascending,
+// so the most urgent/most-negative Priority sorts first), Deadline
+// (earliest first, absent deadlines sort last), QueuedAt (oldest first),
+// then Path to disambiguate. NextRetry deliberately isn't part of the key:
+// it changes on every retry, and Dequeue checks it directly against the
+// primary record instead of re-indexing on every failure.
+func readyIndexKey(e FileEntry) []byte {
+	key := make([]byte, 4+8+8+len(e.Path))
+
+	binary.BigEndian.PutUint32(key[0:4], uint32(int64(e.Priority)-math.MinInt32))
+
+	deadline := int64(math.MaxInt64)
+	if !e.Deadline.IsZero() {
+		deadline = e.Deadline.UnixNano()
+	}
+	binary.BigEndian.PutUint64(key[4:12], uint64(deadline))
+
+	binary.BigEndian.PutUint64(key[12:20], uint64(e.QueuedAt.UnixNano()))
+
+	copy(key[20:], e.Path)
+	return key
+}
+
+// classify matches path's base name against rules in order and returns the
+// first match's class, priority and SLA. No match yields the zero value.
+func classify(path string, rules []ClassRule) (class string, priority int, sla time.Duration) {
+	name := strings.ToLower(filepath.Base(path))
+	for _, r := range rules {
+		matched, _ := filepath.Match(strings.ToLower(r.Pattern), name)
+		if matched {
+			return r.Class, r.Priority, r.SLA
+		}
+	}
+	return "", 0, 0
+}
+
 func backoffDuration(retries int) time.Duration {
 	switch {
 	case retries <= 1:
@@ -0,0 +1,76 @@
+package queue
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestReadyIndexKeyOrdering(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	entries := []FileEntry{
+		{Path: "low-priority.txt", Priority: 10, QueuedAt: base},
+		{Path: "high-priority.txt", Priority: -10, QueuedAt: base},
+		{Path: "default-priority.txt", Priority: 0, QueuedAt: base},
+		{Path: "same-priority-later.txt", Priority: 0, QueuedAt: base.Add(time.Hour)},
+		{Path: "same-priority-earlier-deadline.txt", Priority: 0, QueuedAt: base, Deadline: base.Add(time.Minute)},
+		{Path: "same-priority-no-deadline.txt", Priority: 0, QueuedAt: base},
+	}
+
+	keys := make([][]byte, len(entries))
+	for i, e := range entries {
+		keys[i] = readyIndexKey(e)
+	}
+
+	sorted := append([][]byte(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+
+	want := []string{
+		"high-priority.txt",
+		"same-priority-earlier-deadline.txt",
+		"default-priority.txt",
+		"same-priority-no-deadline.txt",
+		"same-priority-later.txt",
+		"low-priority.txt",
+	}
+
+	pathOf := func(key []byte) string {
+		for i, k := range keys {
+			if bytes.Equal(k, key) {
+				return entries[i].Path
+			}
+		}
+		return ""
+	}
+
+	for i, key := range sorted {
+		if got := pathOf(key); got != want[i] {
+			t.Errorf("position %d: got %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestBackoffDuration(t *testing.T) {
+	cases := []struct {
+		retries int
+		want    time.Duration
+	}{
+		{0, 5 * time.Second},
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 30 * time.Second},
+		{4, 60 * time.Second},
+		{5, 5 * time.Minute},
+		{10, 5 * time.Minute},
+		{11, 30 * time.Minute},
+		{100, 30 * time.Minute},
+	}
+
+	for _, c := range cases {
+		if got := backoffDuration(c.retries); got != c.want {
+			t.Errorf("backoffDuration(%d) = %s, want %s", c.retries, got, c.want)
+		}
+	}
+}
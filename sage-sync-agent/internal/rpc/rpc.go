@@ -0,0 +1,319 @@
+// Package rpc maintains a long-lived JSON-RPC 2.0 control channel from the
+// agent to the DMS server over a WebSocket, so the DMS UI can drive the
+// agent fleet (status, pause/resume, rescans, token rotation) without an
+// operator RDPing into each Sage box.
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dms/sage-sync-agent/internal/queue"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	minReconnectWait = 1 * time.Second
+	maxReconnectWait = 30 * time.Second
+
+	// stableConnectionThreshold is how long a connection must stay up
+	// before a subsequent disconnect is treated as a fresh failure rather
+	// than a continuation of the same outage, resetting the backoff.
+	stableConnectionThreshold = 10 * time.Second
+)
+
+// Request is an inbound JSON-RPC 2.0 call from the DMS server.
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Response is an outbound JSON-RPC 2.0 reply to a Request.
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error is a JSON-RPC 2.0 error object.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Notification is an unsolicited, fire-and-forget push from the agent to
+// the DMS server (file.queued, file.uploaded, file.failed, heartbeat).
+type Notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// StatusResult is the payload returned by the Status method.
+type StatusResult struct {
+	QueueDepth    int                         `json:"queue_depth"`
+	CurrentUpload string                      `json:"current_upload"`
+	Version       string                      `json:"version"`
+	Classes       map[string]queue.ClassCount `json:"classes,omitempty"`
+}
+
+// Handlers are the server-callable methods exposed against the running
+// agent. A nil func is treated as "not implemented" and answered with a
+// JSON-RPC method-not-found style error.
+type Handlers struct {
+	Status       func() (StatusResult, error)
+	Pause        func() error
+	Resume       func() error
+	RescanFolder func() error
+	RetryNow     func(path string) error
+	ReloadConfig func() error
+	RotateToken  func(newToken string) error
+}
+
+// Client owns the control channel connection and dispatches inbound calls
+// to Handlers, reconnecting with jittered backoff if the connection drops.
+type Client struct {
+	dmsURL   string
+	token    string
+	handlers Handlers
+	notify   chan Notification
+	q        *queue.Queue
+}
+
+// New returns a Client ready to Start. q is used only to size the
+// notification buffer against queue activity; it is not required to be
+// non-nil.
+func New(dmsURL, token string, handlers Handlers, q *queue.Queue) *Client {
+	return &Client{
+		dmsURL:   dmsURL,
+		token:    token,
+		handlers: handlers,
+		notify:   make(chan Notification, 64),
+		q:        q,
+	}
+}
+
+// Notify queues a best-effort push to the server; it never blocks, dropping
+// the notification if the channel is full.
+func (c *Client) Notify(method string, params interface{}) {
+	select {
+	case c.notify <- Notification{JSONRPC: "2.0", Method: method, Params: params}:
+	default:
+		log.Warn().Str("method", method).Msg("RPC notification buffer full, dropping")
+	}
+}
+
+// Start connects to the DMS control channel and serves it until ctx is
+// cancelled, reconnecting with jittered backoff on any transport error.
+func (c *Client) Start(ctx context.Context) error {
+	wait := minReconnectWait
+
+	for {
+		stable, err := c.runOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if stable {
+			wait = minReconnectWait
+		}
+
+		log.Warn().Err(err).Dur("retry_in", wait).Msg("RPC control channel disconnected, reconnecting")
+
+		select {
+		case <-time.After(jitter(wait)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		wait *= 2
+		if wait > maxReconnectWait {
+			wait = maxReconnectWait
+		}
+	}
+}
+
+// runOnce connects and serves the control channel until it fails or ctx is
+// cancelled. stable reports whether the connection stayed up for at least
+// stableConnectionThreshold, so Start knows to reset its backoff instead of
+// continuing to double it.
+func (c *Client) runOnce(ctx context.Context) (stable bool, err error) {
+	wsURL, err := toWebsocketURL(c.dmsURL)
+	if err != nil {
+		return false, fmt.Errorf("failed to build control channel URL: %w", err)
+	}
+
+	header := http.Header{}
+	header.Set("X-DMS-Token", c.token)
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		return false, fmt.Errorf("dial failed: %w", err)
+	}
+	defer conn.Close()
+
+	log.Info().Str("url", wsURL).Msg("RPC control channel connected")
+	connectedAt := time.Now()
+
+	// All writes to conn funnel through writeLoop so a response written by
+	// dispatch (one goroutine per inbound call) can never race a
+	// notification write below: gorilla/websocket panics on concurrent
+	// writes to the same connection. done unblocks any goroutine still
+	// waiting to enqueue a write once this connection is going away.
+	done := make(chan struct{})
+	defer close(done)
+
+	writeCh := make(chan interface{}, 64)
+	errCh := make(chan error, 2)
+	go c.writeLoop(conn, writeCh, done, errCh)
+	go c.readLoop(conn, writeCh, done, errCh)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return time.Since(connectedAt) >= stableConnectionThreshold, nil
+		case err := <-errCh:
+			return time.Since(connectedAt) >= stableConnectionThreshold, err
+		case n := <-c.notify:
+			select {
+			case writeCh <- n:
+			case <-done:
+			}
+		}
+	}
+}
+
+// writeLoop is the sole goroutine that ever calls conn.WriteJSON, serializing
+// notification pushes (from runOnce's select loop) and RPC responses (from
+// dispatch) onto a single writer.
+func (c *Client) writeLoop(conn *websocket.Conn, writeCh <-chan interface{}, done <-chan struct{}, errCh chan<- error) {
+	for {
+		select {
+		case msg := <-writeCh:
+			if err := conn.WriteJSON(msg); err != nil {
+				select {
+				case errCh <- err:
+				default:
+				}
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (c *Client) readLoop(conn *websocket.Conn, writeCh chan<- interface{}, done <-chan struct{}, errCh chan<- error) {
+	for {
+		var req Request
+		if err := conn.ReadJSON(&req); err != nil {
+			select {
+			case errCh <- err:
+			default:
+			}
+			return
+		}
+		go c.dispatch(writeCh, done, req)
+	}
+}
+
+func (c *Client) dispatch(writeCh chan<- interface{}, done <-chan struct{}, req Request) {
+	resp := Response{JSONRPC: "2.0", ID: req.ID}
+
+	result, err := c.call(req)
+	if err != nil {
+		resp.Error = &Error{Code: -32000, Message: err.Error()}
+	} else {
+		resp.Result = result
+	}
+
+	select {
+	case writeCh <- resp:
+	case <-done:
+	}
+}
+
+func (c *Client) call(req Request) (interface{}, error) {
+	switch req.Method {
+	case "Status":
+		if c.handlers.Status == nil {
+			return nil, fmt.Errorf("method not implemented: %s", req.Method)
+		}
+		return c.handlers.Status()
+	case "Pause":
+		if c.handlers.Pause == nil {
+			return nil, fmt.Errorf("method not implemented: %s", req.Method)
+		}
+		return nil, c.handlers.Pause()
+	case "Resume":
+		if c.handlers.Resume == nil {
+			return nil, fmt.Errorf("method not implemented: %s", req.Method)
+		}
+		return nil, c.handlers.Resume()
+	case "RescanFolder":
+		if c.handlers.RescanFolder == nil {
+			return nil, fmt.Errorf("method not implemented: %s", req.Method)
+		}
+		return nil, c.handlers.RescanFolder()
+	case "RetryNow":
+		if c.handlers.RetryNow == nil {
+			return nil, fmt.Errorf("method not implemented: %s", req.Method)
+		}
+		var params struct {
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, fmt.Errorf("invalid params: %w", err)
+		}
+		return nil, c.handlers.RetryNow(params.Path)
+	case "ReloadConfig":
+		if c.handlers.ReloadConfig == nil {
+			return nil, fmt.Errorf("method not implemented: %s", req.Method)
+		}
+		return nil, c.handlers.ReloadConfig()
+	case "RotateToken":
+		if c.handlers.RotateToken == nil {
+			return nil, fmt.Errorf("method not implemented: %s", req.Method)
+		}
+		var params struct {
+			NewToken string `json:"new_token"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, fmt.Errorf("invalid params: %w", err)
+		}
+		return nil, c.handlers.RotateToken(params.NewToken)
+	default:
+		return nil, fmt.Errorf("unknown method: %s", req.Method)
+	}
+}
+
+// jitter returns a random duration in [d/2, d), so a fleet of agents
+// reconnecting after a server restart doesn't thunder in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func toWebsocketURL(dmsURL string) (string, error) {
+	u, err := url.Parse(dmsURL)
+	if err != nil {
+		return "", err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/agent/rpc"
+	return u.String(), nil
+}
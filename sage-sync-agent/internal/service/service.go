@@ -1,23 +1,36 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/dms/sage-sync-agent/internal/config"
 	"github.com/kardianos/service"
 	"github.com/rs/zerolog/log"
 )
 
+// shutdownTimeout bounds how long Stop waits for a clean shutdown of run
+// before giving up; the SCM kills the process shortly after Stop returns
+// regardless, so this just determines how much in-flight work gets drained.
+const shutdownTimeout = 30 * time.Second
+
 type program struct {
-	cfg     *config.Config
-	run     func() error
-	stopCh  chan struct{}
+	cfg    *config.Config
+	run    func(ctx context.Context) error
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 func (p *program) Start(s service.Service) error {
-	p.stopCh = make(chan struct{})
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	p.done = make(chan struct{})
+
 	go func() {
-		if err := p.run(); err != nil {
+		defer close(p.done)
+		if err := p.run(ctx); err != nil && !errors.Is(err, context.Canceled) {
 			log.Error().Err(err).Msg("Agent error")
 		}
 	}()
@@ -25,7 +38,13 @@ func (p *program) Start(s service.Service) error {
 }
 
 func (p *program) Stop(s service.Service) error {
-	close(p.stopCh)
+	p.cancel()
+
+	select {
+	case <-p.done:
+	case <-time.After(shutdownTimeout):
+		log.Warn().Dur("timeout", shutdownTimeout).Msg("Timed out waiting for agent to shut down cleanly")
+	}
 	return nil
 }
 
@@ -34,7 +53,7 @@ type Service struct {
 	prg *program
 }
 
-func New(cfg *config.Config, run func() error) *Service {
+func New(cfg *config.Config, run func(ctx context.Context) error) *Service {
 	prg := &program{
 		cfg: cfg,
 		run: run,
@@ -0,0 +1,170 @@
+// Package supervisor runs a set of long-lived child goroutines and keeps
+// them alive, loosely modelled on suture's restart-policy supervision tree.
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RestartPolicy controls what happens to a child once its Run func returns.
+type RestartPolicy int
+
+const (
+	// Permanent children are always restarted, whether Run returned an
+	// error or nil.
+	Permanent RestartPolicy = iota
+	// Transient children are restarted only if Run returned an error.
+	Transient
+	// Temporary children are never restarted, regardless of outcome.
+	Temporary
+)
+
+const (
+	initialBackoff = 1 * time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// ChildFunc is a supervised unit of work. It must return promptly once ctx
+// is cancelled.
+type ChildFunc func(ctx context.Context) error
+
+// Child describes one supervised goroutine.
+type Child struct {
+	Name    string
+	Run     ChildFunc
+	Restart RestartPolicy
+}
+
+// Supervisor owns a group of children, restarting them according to their
+// RestartPolicy with exponential backoff, and recovering panics so that one
+// misbehaving child cannot take down the process.
+type Supervisor struct {
+	children  []Child
+	wg        sync.WaitGroup
+	panicHook func(childName string, rec interface{}, stack string)
+}
+
+// New returns an empty Supervisor.
+func New() *Supervisor {
+	return &Supervisor{}
+}
+
+// SetPanicHook registers a callback invoked whenever runOnce recovers a
+// child's panic, with a dump of every goroutine's stack at the moment of
+// the crash. This is the only place a supervised child's panic is
+// observable from outside the package: main's own top-level recover never
+// fires for these, since each child runs on its own goroutine.
+func (s *Supervisor) SetPanicHook(hook func(childName string, rec interface{}, stack string)) {
+	s.panicHook = hook
+}
+
+// Register adds a child to the supervisor. It must be called before Run.
+func (s *Supervisor) Register(c Child) {
+	s.children = append(s.children, c)
+}
+
+// Run starts every registered child and blocks until ctx is cancelled, then
+// waits for all children to return.
+func (s *Supervisor) Run(ctx context.Context) {
+	for _, c := range s.children {
+		s.wg.Add(1)
+		go s.supervise(ctx, c)
+	}
+	<-ctx.Done()
+	s.wg.Wait()
+}
+
+// Shutdown waits up to timeout for all children started by Run to return.
+// It is intended to be called after the Supervisor's context has been
+// cancelled, to bound how long a graceful stop can take.
+func (s *Supervisor) Shutdown(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("supervisor: timed out after %s waiting for children to stop", timeout)
+	}
+}
+
+func (s *Supervisor) supervise(ctx context.Context, c Child) {
+	defer s.wg.Done()
+
+	backoff := initialBackoff
+	for {
+		err := s.runOnce(ctx, c)
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch c.Restart {
+		case Temporary:
+			return
+		case Transient:
+			if err == nil {
+				return
+			}
+		case Permanent:
+		}
+
+		log.Warn().
+			Str("child", c.Name).
+			Err(err).
+			Dur("backoff", backoff).
+			Msg("Supervised child exited, restarting")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (s *Supervisor) runOnce(ctx context.Context, c Child) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := allStacks()
+			err = fmt.Errorf("panic: %v", r)
+			log.Error().
+				Str("child", c.Name).
+				Interface("panic", r).
+				Str("stack", stack).
+				Msg("Supervised child panicked")
+			if s.panicHook != nil {
+				s.panicHook(c.Name, r, stack)
+			}
+		}
+	}()
+
+	return c.Run(ctx)
+}
+
+// allStacks dumps every goroutine's stack, not just the panicking one, so a
+// crash bundle is actually useful for a concurrency-bug post-mortem.
+func allStacks() string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
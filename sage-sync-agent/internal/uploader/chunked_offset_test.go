@@ -0,0 +1,25 @@
+package uploader
+
+import "testing"
+
+func TestReconcileChunkedOffset(t *testing.T) {
+	cases := []struct {
+		name       string
+		local      int64
+		committed  int64
+		wantOffset int64
+	}{
+		{"server ahead of local", 100, 250, 250},
+		{"server behind local", 250, 100, 250},
+		{"server matches local", 100, 100, 100},
+		{"fresh upload, nothing committed yet", 0, 0, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := reconcileChunkedOffset(c.local, c.committed); got != c.wantOffset {
+				t.Errorf("reconcileChunkedOffset(%d, %d) = %d, want %d", c.local, c.committed, got, c.wantOffset)
+			}
+		})
+	}
+}
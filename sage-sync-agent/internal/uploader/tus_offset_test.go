@@ -0,0 +1,17 @@
+package uploader
+
+import "testing"
+
+func TestReconcileTUSOffset(t *testing.T) {
+	const location = "https://dms.example.com/files/abc123"
+
+	gotLoc, gotOffset := reconcileTUSOffset(location, 512, false)
+	if gotLoc != location || gotOffset != 512 {
+		t.Errorf("live session: got (%q, %d), want (%q, %d)", gotLoc, gotOffset, location, int64(512))
+	}
+
+	gotLoc, gotOffset = reconcileTUSOffset(location, 512, true)
+	if gotLoc != "" || gotOffset != 0 {
+		t.Errorf("gone session: got (%q, %d), want (\"\", 0)", gotLoc, gotOffset)
+	}
+}
@@ -2,15 +2,23 @@ package uploader
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dms/sage-sync-agent/internal/queue"
@@ -18,50 +26,163 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// Upload protocols selectable via config.Config.UploadProtocol.
+const (
+	ProtocolChunked = "chunked"
+	ProtocolTUS     = "tus"
+)
+
+// httpStatusError carries the HTTP status and a response snippet so a
+// failed upload can surface enough detail for an upload_error report
+// without every call site needing its own bookkeeping.
+type httpStatusError struct {
+	statusCode int
+	snippet    string
+	err        error
+}
+
+func (e *httpStatusError) Error() string { return e.err.Error() }
+func (e *httpStatusError) Unwrap() error { return e.err }
+
+// Notifier pushes a fire-and-forget event to the DMS control channel.
+type Notifier interface {
+	Notify(method string, params interface{})
+}
+
+// ErrorReporter ships a diagnostic bundle for a file whose upload
+// exhausted its retry budget, so operators can debug a tenant-specific
+// ingest regression without needing access to the customer's machine.
+type ErrorReporter interface {
+	ReportUploadError(path, hash, mimeType string, size int64, statusCode int, responseSnippet string)
+}
+
+// maxRetriesBeforeReport is the retry budget: once a file has failed this
+// many times, processQueue ships an upload_error report instead of staying
+// silent until an operator notices the file is stuck.
+const maxRetriesBeforeReport = 5
+
 type Uploader struct {
 	dmsURL          string
-	token           string
+	token           atomic.Value // string
 	processedFolder string
+	tenantCode      string
+	protocol        string
+	hashPrecheck    bool
 	client          *http.Client
-	done            chan struct{}
+	paused          atomic.Bool
+	notifier        Notifier
+	errorReporter   ErrorReporter
+	currentUpload   atomic.Value // string, path of the file in flight
+
+	rateLimits map[string]int
+	limitersMu sync.Mutex
+	limiters   map[string]*tokenBucket
 }
 
-func New(dmsURL, token, processedFolder string) *Uploader {
+// New returns an Uploader. rateLimits caps how many files per class may be
+// uploaded per minute (class "" covers files with no class rule); classes
+// absent from the map are unlimited. This stops a burst of low-priority
+// documents from monopolizing the uplink and starving higher-priority
+// classes of bandwidth. protocol selects the transfer protocol (see
+// ProtocolChunked/ProtocolTUS); an empty string behaves like
+// ProtocolChunked. hashPrecheck enables a by-hash existence check before
+// each upload, skipping files the DMS already has.
+func New(dmsURL, token, processedFolder, tenantCode, protocol string, hashPrecheck bool, rateLimits map[string]int) *Uploader {
 	retryClient := retryablehttp.NewClient()
 	retryClient.RetryMax = 3
 	retryClient.RetryWaitMin = 1 * time.Second
 	retryClient.RetryWaitMax = 10 * time.Second
 	retryClient.Logger = nil
 
-	return &Uploader{
+	u := &Uploader{
 		dmsURL:          dmsURL,
-		token:           token,
 		processedFolder: processedFolder,
+		tenantCode:      tenantCode,
+		protocol:        protocol,
+		hashPrecheck:    hashPrecheck,
 		client:          retryClient.StandardClient(),
-		done:            make(chan struct{}),
+		rateLimits:      rateLimits,
+		limiters:        make(map[string]*tokenBucket),
 	}
+	u.token.Store(token)
+	u.currentUpload.Store("")
+	return u
+}
+
+// Token returns the bearer token currently used to authenticate requests.
+func (u *Uploader) Token() string {
+	return u.token.Load().(string)
+}
+
+// CurrentUpload returns the path of the file currently being uploaded, or
+// "" if the uploader is idle.
+func (u *Uploader) CurrentUpload() string {
+	return u.currentUpload.Load().(string)
+}
+
+// SetToken replaces the bearer token used for subsequent requests, e.g.
+// after an RPC-triggered rotation.
+func (u *Uploader) SetToken(token string) {
+	u.token.Store(token)
+}
+
+// SetNotifier wires an RPC notifier so upload outcomes are pushed to the
+// DMS control channel as they happen.
+func (u *Uploader) SetNotifier(n Notifier) {
+	u.notifier = n
+}
+
+// SetErrorReporter wires a reporter so uploads that exhaust their retry
+// budget produce an upload_error bundle for the DMS.
+func (u *Uploader) SetErrorReporter(r ErrorReporter) {
+	u.errorReporter = r
+}
+
+// Pause stops the upload loop from dequeuing new work; files already
+// in-flight are left to finish.
+func (u *Uploader) Pause() {
+	u.paused.Store(true)
+}
+
+// Resume re-enables the upload loop after a Pause.
+func (u *Uploader) Resume() {
+	u.paused.Store(false)
+}
+
+// Paused reports whether the upload loop is currently paused.
+func (u *Uploader) Paused() bool {
+	return u.paused.Load()
 }
 
-func (u *Uploader) Start(q *queue.Queue) {
+// Start polls the queue for ready files and uploads them until ctx is
+// cancelled.
+func (u *Uploader) Start(ctx context.Context, q *queue.Queue) error {
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
+			if u.Paused() {
+				continue
+			}
 			u.processQueue(q)
-		case <-u.done:
-			return
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
-func (u *Uploader) Stop() {
-	close(u.done)
-}
+// defaultChunkSize is used for the first PATCH of an upload; subsequent
+// chunks use whatever size the server advertised in the POST /uploads
+// response.
+const defaultChunkSize = 8 * 1024 * 1024
 
 func (u *Uploader) processQueue(q *queue.Queue) {
-	entry, err := q.Dequeue()
+	// Dequeue itself skips classes that are over their rate limit, scanning
+	// past them to the next eligible entry, so a throttled class can never
+	// head-of-line-block the others.
+	entry, err := q.Dequeue(u.allowClass)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to dequeue")
 		return
@@ -72,8 +193,17 @@ func (u *Uploader) processQueue(q *queue.Queue) {
 
 	log.Info().Str("file", entry.Path).Msg("Processing file")
 
-	if err := u.uploadFile(entry.Path); err != nil {
+	u.currentUpload.Store(entry.Path)
+	defer u.currentUpload.Store("")
+
+	if err := u.uploadFile(q, entry); err != nil {
 		q.MarkFailed(entry.Path, err.Error())
+		if u.notifier != nil {
+			u.notifier.Notify("file.failed", map[string]interface{}{"path": entry.Path, "error": err.Error()})
+		}
+		if entry.Retries+1 == maxRetriesBeforeReport {
+			u.reportUploadError(entry, err)
+		}
 		return
 	}
 
@@ -83,44 +213,489 @@ func (u *Uploader) processQueue(q *queue.Queue) {
 
 	q.MarkComplete(entry.Path)
 	log.Info().Str("file", entry.Path).Msg("Upload successful")
+	if u.notifier != nil {
+		u.notifier.Notify("file.uploaded", map[string]interface{}{"path": entry.Path})
+	}
+}
+
+// uploadFile drives whichever upload protocol is configured: a file is
+// sliced into fixed-size chunks read straight off disk (never buffered
+// whole into memory) and streamed, so a transfer that fails partway through
+// resumes from the last committed offset on retry instead of starting over.
+//
+// The hash is only precomputed with a dedicated read pass when something
+// downstream needs it before the transfer starts: hash-precheck has to know
+// the digest to decide whether to upload at all, a resumed transfer can't
+// recover a partial hash across a restart, and tus.io has no finalize step
+// to carry a hash computed after the fact. A fresh chunked upload has none
+// of those constraints, so it folds the digest into the chunk-streaming
+// pass instead (see streamChunks) and only reads the file once.
+func (u *Uploader) uploadFile(q *queue.Queue, entry *queue.FileEntry) error {
+	path := entry.Path
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	hash := entry.Checksum
+	resuming := entry.UploadID != ""
+	needsUpfrontHash := hash == "" && (u.hashPrecheck || resuming || u.protocol == ProtocolTUS)
+	if needsUpfrontHash {
+		hash, err = computeHash(path)
+		if err != nil {
+			return fmt.Errorf("failed to compute hash: %w", err)
+		}
+	}
+
+	if u.hashPrecheck && hash != "" && u.alreadyIngested(hash) {
+		log.Info().Str("file", path).Str("sha256", hash).Msg("DMS already has this document by hash, skipping upload")
+		return nil
+	}
+
+	if u.protocol == ProtocolTUS {
+		return u.uploadFileTUS(q, entry, info, hash)
+	}
+	return u.uploadFileChunked(q, entry, info, hash)
+}
+
+// alreadyIngested asks the DMS whether hash is already ingested so the
+// caller can skip a redundant upload; computeHash already paid for reading
+// the whole file, so this check is nearly free in comparison. It fails
+// open: any transport error or unexpected status is treated as "not
+// known to exist" rather than blocking the upload.
+func (u *Uploader) alreadyIngested(hash string) bool {
+	url := fmt.Sprintf("%s/api/v1/ingest/document/by-hash/%s", u.dmsURL, hash)
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("X-DMS-Token", u.Token())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent
+}
+
+func (u *Uploader) uploadFileChunked(q *queue.Queue, entry *queue.FileEntry, info os.FileInfo, hash string) error {
+	path := entry.Path
+	uploadID := entry.UploadID
+	offset := entry.Offset
+
+	if uploadID == "" {
+		uploadID, chunkSize, err := u.startUpload(path, info.Size(), hash)
+		if err != nil {
+			return fmt.Errorf("failed to start upload: %w", err)
+		}
+		if err := q.UpdateProgress(path, uploadID, 0, hash); err != nil {
+			return fmt.Errorf("failed to persist upload state: %w", err)
+		}
+		return u.streamChunks(q, path, uploadID, hash, 0, chunkSize, info.Size())
+	}
+
+	committed, err := u.probeUpload(uploadID)
+	if err != nil {
+		return fmt.Errorf("failed to probe upload %s: %w", uploadID, err)
+	}
+	if resumed := reconcileChunkedOffset(offset, committed); resumed != offset {
+		offset = resumed
+		if err := q.UpdateProgress(path, uploadID, offset, hash); err != nil {
+			return fmt.Errorf("failed to persist upload state: %w", err)
+		}
+	}
+
+	return u.streamChunks(q, path, uploadID, hash, offset, defaultChunkSize, info.Size())
+}
+
+// reconcileChunkedOffset decides the offset to resume a chunked upload
+// from, given what's locally persisted and what the server reports
+// committed. The server is authoritative: a locally persisted offset can
+// lag behind a chunk the server actually committed if the PATCH response
+// was lost in transit after the fact, so the offset should only ever move
+// forward to match it, never backward.
+func reconcileChunkedOffset(localOffset, committed int64) int64 {
+	if committed > localOffset {
+		return committed
+	}
+	return localOffset
 }
 
-func (u *Uploader) uploadFile(path string) error {
+// streamChunks PATCHes path to uploadID starting at offset until the whole
+// file has been committed, then finalizes the upload. If hash is empty
+// (a fresh upload started without one, see uploadFile), the SHA-256 is
+// folded into the same read by tee-ing each chunk through a running
+// hasher as it's streamed, and the digest computed here is what
+// completeUpload sends — trading the upfront integrity check for a single
+// pass over the file instead of two.
+func (u *Uploader) streamChunks(q *queue.Queue, path, uploadID, hash string, offset, chunkSize, size int64) error {
 	file, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	hash, err := computeHash(path)
+	var hasher io.Writer
+	var sumHash func() string
+	if hash == "" {
+		if offset != 0 {
+			return fmt.Errorf("cannot resume upload %s without a known hash", uploadID)
+		}
+		h := sha256.New()
+		hasher = h
+		sumHash = func() string { return hex.EncodeToString(h.Sum(nil)) }
+	}
+
+	for offset < size {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek to offset %d: %w", offset, err)
+		}
+
+		length := chunkSize
+		if remaining := size - offset; remaining < length {
+			length = remaining
+		}
+
+		var reader io.Reader = io.LimitReader(file, length)
+		if hasher != nil {
+			reader = io.TeeReader(reader, hasher)
+		}
+
+		newOffset, err := u.uploadChunk(uploadID, offset, reader, length)
+		if err != nil {
+			return fmt.Errorf("failed to upload chunk at offset %d: %w", offset, err)
+		}
+
+		offset = newOffset
+		if err := q.UpdateProgress(path, uploadID, offset, hash); err != nil {
+			return fmt.Errorf("failed to persist upload state: %w", err)
+		}
+	}
+
+	if sumHash != nil {
+		hash = sumHash()
+	}
+
+	return u.completeUpload(uploadID, hash)
+}
+
+// tusResumableVersion is the tus.io protocol version this client speaks.
+const tusResumableVersion = "1.0.0"
+
+// uploadFileTUS drives the tus.io resumable upload handshake: the queue
+// entry's UploadID field doubles as the tus Location URL (there's no
+// separate server-assigned ID in tus, the Location is the session), and a
+// HEAD against it recovers the server's committed offset on retry instead
+// of trusting the locally persisted one, since the two can diverge if a
+// prior PATCH response was lost in transit.
+func (u *Uploader) uploadFileTUS(q *queue.Queue, entry *queue.FileEntry, info os.FileInfo, hash string) error {
+	path := entry.Path
+	location := entry.UploadID
+	offset := entry.Offset
+
+	if location != "" {
+		committed, gone, err := u.tusHead(location)
+		if err != nil {
+			return fmt.Errorf("failed to probe tus upload: %w", err)
+		}
+		location, offset = reconcileTUSOffset(location, committed, gone)
+	}
+
+	if location == "" {
+		loc, err := u.tusCreate(path, info.Size(), hash)
+		if err != nil {
+			return fmt.Errorf("failed to create tus upload: %w", err)
+		}
+		location = loc
+		offset = 0
+	}
+
+	if err := q.UpdateProgress(path, location, offset, hash); err != nil {
+		return fmt.Errorf("failed to persist upload state: %w", err)
+	}
+
+	return u.tusStream(q, path, location, hash, offset, info.Size())
+}
+
+// reconcileTUSOffset decides the upload-session location and offset to
+// resume a tus upload from, given a HEAD probe against the existing
+// session. A gone session (404/410) must be recreated from scratch, so it
+// discards both the location and any locally persisted offset; otherwise
+// the server's committed offset is authoritative, since there is no
+// separate local offset to reconcile against in the tus protocol.
+func reconcileTUSOffset(location string, committed int64, gone bool) (string, int64) {
+	if gone {
+		return "", 0
+	}
+	return location, committed
+}
+
+// tusCreate issues the tus creation POST and returns the absolute Location
+// URL of the new upload session.
+func (u *Uploader) tusCreate(path string, size int64, hash string) (string, error) {
+	metadata := strings.Join([]string{
+		"filename " + base64.StdEncoding.EncodeToString([]byte(filepath.Base(path))),
+		"sha256 " + base64.StdEncoding.EncodeToString([]byte(hash)),
+		"source " + base64.StdEncoding.EncodeToString([]byte("sage-sync-agent")),
+		"tenant_code " + base64.StdEncoding.EncodeToString([]byte(u.tenantCode)),
+	}, ",")
+
+	endpoint := fmt.Sprintf("%s/api/v1/ingest/tus/", u.dmsURL)
+	req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Tus-Resumable", tusResumableVersion)
+	req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("Upload-Metadata", metadata)
+	req.Header.Set("X-DMS-Token", u.Token())
+
+	resp, err := u.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to compute hash: %w", err)
+		return "", fmt.Errorf("request failed: %w", err)
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", &httpStatusError{statusCode: resp.StatusCode, snippet: string(respBody), err: fmt.Errorf("tus create failed with status %d: %s", resp.StatusCode, string(respBody))}
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("tus create response missing Location header")
+	}
+	return u.resolveLocation(location)
+}
+
+// resolveLocation resolves a possibly-relative Location header against
+// dmsURL, since the tus spec allows servers to return either.
+func (u *Uploader) resolveLocation(location string) (string, error) {
+	base, err := neturl.Parse(u.dmsURL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := neturl.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
 
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
+// tusHead asks the server for the upload's current committed offset. gone
+// reports a 404/410, meaning the session no longer exists and the upload
+// must be recreated from scratch.
+func (u *Uploader) tusHead(location string) (offset int64, gone bool, err error) {
+	req, err := http.NewRequest(http.MethodHead, location, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Tus-Resumable", tusResumableVersion)
+	req.Header.Set("X-DMS-Token", u.Token())
 
-	part, err := writer.CreateFormFile("file", filepath.Base(path))
+	resp, err := u.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to create form file: %w", err)
+		return 0, false, fmt.Errorf("request failed: %w", err)
 	}
+	defer resp.Body.Close()
 
-	if _, err := io.Copy(part, file); err != nil {
-		return fmt.Errorf("failed to copy file content: %w", err)
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return 0, true, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return 0, false, &httpStatusError{statusCode: resp.StatusCode, err: fmt.Errorf("tus HEAD failed with status %d", resp.StatusCode)}
 	}
 
-	writer.WriteField("sha256", hash)
-	writer.WriteField("source", "sage-sync-agent")
-	writer.Close()
+	offset, err = strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to parse upload offset: %w", err)
+	}
+	return offset, false, nil
+}
 
-	url := fmt.Sprintf("%s/api/v1/ingest/document/", u.dmsURL)
-	req, err := http.NewRequest("POST", url, &body)
+// tusStream PATCHes path to location starting at offset until the server
+// has committed the whole file; tus has no separate finalize step, the
+// upload completes the moment its committed offset reaches Upload-Length.
+func (u *Uploader) tusStream(q *queue.Queue, path, location, hash string, offset, size int64) error {
+	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to open file: %w", err)
 	}
+	defer file.Close()
 
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("X-DMS-Token", u.token)
+	for offset < size {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek to offset %d: %w", offset, err)
+		}
+
+		length := int64(defaultChunkSize)
+		if remaining := size - offset; remaining < length {
+			length = remaining
+		}
+
+		newOffset, err := u.tusPatch(location, offset, io.LimitReader(file, length), length)
+		if err != nil {
+			return fmt.Errorf("failed to upload chunk at offset %d: %w", offset, err)
+		}
+
+		offset = newOffset
+		if err := q.UpdateProgress(path, location, offset, hash); err != nil {
+			return fmt.Errorf("failed to persist upload state: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (u *Uploader) tusPatch(location string, offset int64, chunk io.Reader, length int64) (int64, error) {
+	req, err := http.NewRequest(http.MethodPatch, location, chunk)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("Tus-Resumable", tusResumableVersion)
+	req.Header.Set("X-DMS-Token", u.Token())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return 0, &httpStatusError{statusCode: resp.StatusCode, snippet: string(respBody), err: fmt.Errorf("tus PATCH failed with status %d: %s", resp.StatusCode, string(respBody))}
+	}
+
+	newOffset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse upload offset: %w", err)
+	}
+	return newOffset, nil
+}
+
+type startUploadResponse struct {
+	UploadID  string `json:"upload_id"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+// startUpload opens an upload session. hash may be empty, in which case
+// the digest is still unknown at session-creation time and completeUpload
+// carries it once streamChunks has computed it.
+func (u *Uploader) startUpload(path string, size int64, hash string) (string, int64, error) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"path":   path,
+		"size":   size,
+		"sha256": hash,
+		"source": "sage-sync-agent",
+	})
+
+	url := fmt.Sprintf("%s/api/v1/ingest/uploads", u.dmsURL)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-DMS-Token", u.Token())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", 0, &httpStatusError{statusCode: resp.StatusCode, snippet: string(respBody), err: fmt.Errorf("start upload failed with status %d: %s", resp.StatusCode, string(respBody))}
+	}
+
+	var parsed startUploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return "", 0, fmt.Errorf("failed to decode start upload response: %w", err)
+	}
+	if parsed.ChunkSize <= 0 {
+		parsed.ChunkSize = defaultChunkSize
+	}
+
+	return parsed.UploadID, parsed.ChunkSize, nil
+}
+
+// probeUpload asks the server how much of uploadID it has actually
+// committed, so the client can reconcile if the server saw more bytes than
+// it last acknowledged (e.g. the previous response was lost in transit).
+func (u *Uploader) probeUpload(uploadID string) (int64, error) {
+	url := fmt.Sprintf("%s/api/v1/ingest/uploads/%s", u.dmsURL, uploadID)
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-DMS-Token", u.Token())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return 0, &httpStatusError{statusCode: resp.StatusCode, err: fmt.Errorf("probe upload failed with status %d", resp.StatusCode)}
+	}
+
+	offset, err := strconv.ParseInt(resp.Header.Get("X-Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse committed offset: %w", err)
+	}
+	return offset, nil
+}
+
+type uploadChunkResponse struct {
+	Offset int64 `json:"offset"`
+}
+
+func (u *Uploader) uploadChunk(uploadID string, offset int64, chunk io.Reader, length int64) (int64, error) {
+	url := fmt.Sprintf("%s/api/v1/ingest/uploads/%s?offset=%d", u.dmsURL, uploadID, offset)
+	req, err := http.NewRequest(http.MethodPatch, url, chunk)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-DMS-Token", u.Token())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return 0, &httpStatusError{statusCode: resp.StatusCode, snippet: string(respBody), err: fmt.Errorf("chunk upload failed with status %d: %s", resp.StatusCode, string(respBody))}
+	}
+
+	var parsed uploadChunkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return 0, fmt.Errorf("failed to decode chunk response: %w", err)
+	}
+
+	return parsed.Offset, nil
+}
+
+func (u *Uploader) completeUpload(uploadID, hash string) error {
+	payload, _ := json.Marshal(map[string]interface{}{"sha256": hash})
+
+	url := fmt.Sprintf("%s/api/v1/ingest/uploads/%s/complete", u.dmsURL, uploadID)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-DMS-Token", u.Token())
 
 	resp, err := u.client.Do(req)
 	if err != nil {
@@ -129,13 +704,13 @@ func (u *Uploader) uploadFile(path string) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusConflict {
-		log.Info().Str("file", path).Msg("File already exists (duplicate)")
+		log.Info().Str("upload", uploadID).Msg("File already exists (duplicate)")
 		return nil
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, string(respBody))
+		return &httpStatusError{statusCode: resp.StatusCode, snippet: string(respBody), err: fmt.Errorf("complete upload failed with status %d: %s", resp.StatusCode, string(respBody))}
 	}
 
 	return nil
@@ -158,6 +733,53 @@ func (u *Uploader) moveToProcessed(path string) error {
 	return os.Rename(path, destPath)
 }
 
+// reportUploadError ships a lighter diagnostic bundle for entry once its
+// upload has exhausted its retry budget, reusing whatever hash was already
+// computed and pulling the HTTP status/response snippet back out of
+// uploadErr when the failure came from one of the HTTP calls above.
+func (u *Uploader) reportUploadError(entry *queue.FileEntry, uploadErr error) {
+	if u.errorReporter == nil {
+		return
+	}
+
+	hash := entry.Checksum
+	if hash == "" {
+		if h, err := computeHash(entry.Path); err == nil {
+			hash = h
+		}
+	}
+
+	var size int64
+	if info, err := os.Stat(entry.Path); err == nil {
+		size = info.Size()
+	}
+
+	statusCode := 0
+	snippet := uploadErr.Error()
+	var httpErr *httpStatusError
+	if errors.As(uploadErr, &httpErr) {
+		statusCode = httpErr.statusCode
+		snippet = httpErr.snippet
+	}
+
+	u.errorReporter.ReportUploadError(entry.Path, hash, detectMimeType(entry.Path), size, statusCode, snippet)
+}
+
+// detectMimeType sniffs a file's content type from its first 512 bytes,
+// returning "" if the file can no longer be read (e.g. it was moved away
+// between the failed upload and the report).
+func detectMimeType(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+	n, _ := f.Read(buf)
+	return http.DetectContentType(buf[:n])
+}
+
 func computeHash(path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -173,7 +795,23 @@ func computeHash(path string) (string, error) {
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func (u *Uploader) StartHeartbeat(intervalSeconds int, version string) {
+// HeartbeatCommands is the JSON body the heartbeat endpoint may respond
+// with, letting an operator drive an agent that isn't reachable over the
+// RPC control channel (e.g. behind a restrictive branch-office firewall).
+type HeartbeatCommands struct {
+	Pause   bool `json:"pause"`
+	Reindex bool `json:"reindex"`
+}
+
+// StartHeartbeat periodically reports agent status and queue telemetry to
+// the DMS until ctx is cancelled. onRescan, if non-nil, is invoked when a
+// heartbeat response requests a reindex. onSuccess, if non-nil, is invoked
+// after each heartbeat the DMS acknowledges, so pending crash/error reports
+// can piggyback on connectivity the agent just proved it has. tokenSource,
+// if non-nil, is called fresh on every beat and its result reported so an
+// operator can see whether an agent has fallen back to a weaker token
+// storage backend.
+func (u *Uploader) StartHeartbeat(ctx context.Context, intervalSeconds int, version, watchFolder string, q *queue.Queue, onRescan, onSuccess func(), tokenSource func() string) error {
 	if intervalSeconds <= 0 {
 		intervalSeconds = 300
 	}
@@ -181,23 +819,43 @@ func (u *Uploader) StartHeartbeat(intervalSeconds int, version string) {
 	ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
 	defer ticker.Stop()
 
-	u.sendHeartbeat(version, 0)
+	startedAt := time.Now()
+	u.sendHeartbeat(version, watchFolder, q, startedAt, onRescan, onSuccess, tokenSource)
 
 	for {
 		select {
 		case <-ticker.C:
-			u.sendHeartbeat(version, 0)
-		case <-u.done:
-			return
+			u.sendHeartbeat(version, watchFolder, q, startedAt, onRescan, onSuccess, tokenSource)
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
-func (u *Uploader) sendHeartbeat(version string, queueSize int) {
+func (u *Uploader) sendHeartbeat(version, watchFolder string, q *queue.Queue, startedAt time.Time, onRescan, onSuccess func(), tokenSource func() string) {
+	stats := q.Stats()
+	hostname, _ := os.Hostname()
+
 	payload := map[string]interface{}{
-		"version":    version,
-		"status":     "running",
-		"queue_size": queueSize,
+		"version":                version,
+		"status":                 "running",
+		"queue_size":             stats.Pending,
+		"failed_count":           stats.Failed,
+		"last_upload_at":         stats.LastUploadAt,
+		"oldest_pending_seconds": int(stats.OldestPendingAge.Seconds()),
+		"watch_folder":           watchFolder,
+		"tenant_code":            u.tenantCode,
+		"hostname":               hostname,
+		"os":                     runtime.GOOS,
+		"uptime_seconds":         int(time.Since(startedAt).Seconds()),
+		"classes":                q.ClassCounts(),
+	}
+	if tokenSource != nil {
+		payload["token_source"] = tokenSource()
+	}
+
+	if u.notifier != nil {
+		u.notifier.Notify("heartbeat", payload)
 	}
 
 	data, _ := json.Marshal(payload)
@@ -210,7 +868,7 @@ func (u *Uploader) sendHeartbeat(version string, queueSize int) {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-DMS-Token", u.token)
+	req.Header.Set("X-DMS-Token", u.Token())
 
 	resp, err := u.client.Do(req)
 	if err != nil {
@@ -219,7 +877,84 @@ func (u *Uploader) sendHeartbeat(version string, queueSize int) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		log.Debug().Msg("Heartbeat sent")
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return
+	}
+	log.Debug().Msg("Heartbeat sent")
+
+	if onSuccess != nil {
+		onSuccess()
+	}
+
+	u.dispatchHeartbeatCommands(resp.Body, onRescan)
+}
+
+// dispatchHeartbeatCommands decodes an optional command body from the
+// heartbeat response and acts on it; a missing or unparsable body is
+// treated as "no commands" rather than an error.
+func (u *Uploader) dispatchHeartbeatCommands(body io.Reader, onRescan func()) {
+	var cmds HeartbeatCommands
+	if err := json.NewDecoder(body).Decode(&cmds); err != nil {
+		return
+	}
+
+	if cmds.Pause && !u.Paused() {
+		log.Info().Msg("Heartbeat response requested pause")
+		u.Pause()
+	}
+	if cmds.Reindex && onRescan != nil {
+		log.Info().Msg("Heartbeat response requested a reindex")
+		onRescan()
+	}
+}
+
+// allowClass reports whether a file in class may be uploaded now under its
+// configured per-minute rate limit, consuming a token if so. Classes with
+// no configured limit are always allowed.
+func (u *Uploader) allowClass(class string) bool {
+	limit, ok := u.rateLimits[class]
+	if !ok || limit <= 0 {
+		return true
+	}
+
+	u.limitersMu.Lock()
+	b, ok := u.limiters[class]
+	if !ok {
+		b = newTokenBucket(float64(limit) / 60)
+		u.limiters[class] = b
+	}
+	u.limitersMu.Unlock()
+
+	return b.take()
+}
+
+// tokenBucket is a simple per-class rate limiter: tokens refill continuously
+// at ratePerSec and up to one file's worth of burst can be saved up.
+type tokenBucket struct {
+	mu         sync.Mutex
+	tokens     float64
+	ratePerSec float64
+	last       time.Time
+}
+
+func newTokenBucket(ratePerSec float64) *tokenBucket {
+	return &tokenBucket{tokens: 1, ratePerSec: ratePerSec, last: time.Now()}
+}
+
+func (b *tokenBucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.ratePerSec
+	if b.tokens > 1 {
+		b.tokens = 1
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
 	}
+	b.tokens--
+	return true
 }
@@ -0,0 +1,55 @@
+package uploader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurstThenRefill(t *testing.T) {
+	b := newTokenBucket(1000) // 1000 tokens/sec, so refill is fast but observable
+
+	if !b.take() {
+		t.Fatal("first take() should succeed: bucket starts full")
+	}
+	if b.take() {
+		t.Fatal("immediate second take() should fail: no time has passed to refill")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if !b.take() {
+		t.Fatal("take() after refill window should succeed")
+	}
+}
+
+func TestAllowClassUnlimitedWhenNoRule(t *testing.T) {
+	u := &Uploader{
+		rateLimits: map[string]int{},
+		limiters:   make(map[string]*tokenBucket),
+	}
+
+	for i := 0; i < 10; i++ {
+		if !u.allowClass("unclassified") {
+			t.Fatalf("call %d: class with no configured limit should always be allowed", i)
+		}
+	}
+}
+
+func TestAllowClassThrottlesOverBudget(t *testing.T) {
+	u := &Uploader{
+		rateLimits: map[string]int{"bulk": 60}, // 60/min == 1/sec
+		limiters:   make(map[string]*tokenBucket),
+	}
+
+	if !u.allowClass("bulk") {
+		t.Fatal("first call should consume the initial burst token")
+	}
+	if u.allowClass("bulk") {
+		t.Fatal("second call immediately after should be throttled")
+	}
+
+	// A different class sharing no bucket with "bulk" must be unaffected.
+	if !u.allowClass("other") {
+		t.Fatal("an unrelated class must not be throttled by bulk's limiter")
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+
+package watcher
+
+func isFileReadyWindows(path string) bool {
+	return false
+}
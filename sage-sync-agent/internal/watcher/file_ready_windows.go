@@ -3,7 +3,6 @@
 package watcher
 
 import (
-	"os"
 	"syscall"
 )
 
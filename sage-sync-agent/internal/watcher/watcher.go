@@ -1,6 +1,7 @@
 package watcher
 
 import (
+        "context"
         "os"
         "path/filepath"
         "strings"
@@ -12,15 +13,20 @@ import (
         "github.com/rs/zerolog/log"
 )
 
+// Notifier pushes a fire-and-forget event to the DMS control channel.
+type Notifier interface {
+        Notify(method string, params interface{})
+}
+
 type Watcher struct {
         folder           string
         patterns         []string
         stabilitySeconds int
         queue            *queue.Queue
+        notifier         Notifier
 
         pending     map[string]time.Time
         pendingLock sync.Mutex
-        done        chan struct{}
 }
 
 func New(folder string, patterns []string, stabilitySeconds int, q *queue.Queue) *Watcher {
@@ -36,11 +42,11 @@ func New(folder string, patterns []string, stabilitySeconds int, q *queue.Queue)
                 stabilitySeconds: stabilitySeconds,
                 queue:            q,
                 pending:          make(map[string]time.Time),
-                done:             make(chan struct{}),
         }
 }
 
-func (w *Watcher) Start() error {
+// Start watches the folder for new files until ctx is cancelled.
+func (w *Watcher) Start(ctx context.Context) error {
         watcher, err := fsnotify.NewWatcher()
         if err != nil {
                 return err
@@ -59,7 +65,7 @@ func (w *Watcher) Start() error {
 
         w.scanExisting()
 
-        go w.stabilityChecker()
+        go w.stabilityChecker(ctx)
 
         for {
                 select {
@@ -73,14 +79,40 @@ func (w *Watcher) Start() error {
                                 return nil
                         }
                         log.Error().Err(err).Msg("Watcher error")
-                case <-w.done:
-                        return nil
+                case <-ctx.Done():
+                        return ctx.Err()
                 }
         }
 }
 
-func (w *Watcher) Stop() {
-        close(w.done)
+// SetNotifier wires an RPC notifier so queued files are pushed to the DMS
+// control channel as they're detected.
+func (w *Watcher) SetNotifier(n Notifier) {
+        w.notifier = n
+}
+
+// UpdateSettings applies a new set of include patterns and stability window,
+// e.g. after an RPC-triggered config reload. It takes effect on the next
+// stability check and does not require restarting the watcher.
+func (w *Watcher) UpdateSettings(patterns []string, stabilitySeconds int) {
+	if len(patterns) == 0 {
+		patterns = []string{"*.pdf", "*.xlsx", "*.docx"}
+	}
+	if stabilitySeconds <= 0 {
+		stabilitySeconds = 5
+	}
+
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	w.patterns = patterns
+	w.stabilitySeconds = stabilitySeconds
+}
+
+// Rescan re-walks the watch folder for files that are already present but
+// were missed or not yet stable, e.g. in response to an operator-triggered
+// rescan over RPC.
+func (w *Watcher) Rescan() {
+	w.scanExisting()
 }
 
 func (w *Watcher) scanExisting() {
@@ -116,7 +148,11 @@ func (w *Watcher) handleEvent(event fsnotify.Event) {
 }
 
 func (w *Watcher) matchesPattern(name string) bool {
-        for _, pattern := range w.patterns {
+        w.pendingLock.Lock()
+        patterns := w.patterns
+        w.pendingLock.Unlock()
+
+        for _, pattern := range patterns {
                 matched, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(name))
                 if matched {
                         return true
@@ -131,7 +167,7 @@ func (w *Watcher) addToPending(path string) {
         w.pending[path] = time.Now()
 }
 
-func (w *Watcher) stabilityChecker() {
+func (w *Watcher) stabilityChecker(ctx context.Context) {
         ticker := time.NewTicker(time.Second)
         defer ticker.Stop()
 
@@ -139,7 +175,7 @@ func (w *Watcher) stabilityChecker() {
                 select {
                 case <-ticker.C:
                         w.checkPending()
-                case <-w.done:
+                case <-ctx.Done():
                         return
                 }
         }
@@ -175,6 +211,9 @@ func (w *Watcher) checkPending() {
                 }
 
                 log.Info().Str("file", path).Int64("size", info.Size()).Msg("File queued for upload")
+                if w.notifier != nil {
+                        w.notifier.Notify("file.queued", map[string]interface{}{"path": path, "size": info.Size()})
+                }
                 delete(w.pending, path)
         }
 }